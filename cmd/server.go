@@ -1,20 +1,34 @@
 package cmd
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	pb "github.com/previousnext/m8s/pb"
 	"github.com/previousnext/m8s/server"
+	"github.com/previousnext/m8s/server/tlsreload"
+	"github.com/previousnext/m8s/server/tokenreload"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"gopkg.in/alecthomas/kingpin.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -23,22 +37,29 @@ type cmdServer struct {
 	TLSCert string
 	TLSKey  string
 
-	Token     string
-	Namespace string
+	Token               string
+	TokenFile           string
+	TokenReloadInterval time.Duration
+	Namespace           string
 
 	FilesystemSize string
 
-	LetsEncryptEmail  string
-	LetsEncryptDomain string
-	LetsEncryptCache  string
+	PVCStorageClass string
+
+	LetsEncryptEmail    string
+	LetsEncryptDomain   []string
+	LetsEncryptCache    string
+	LetsEncryptCAServer string
+
+	TLSProfile        string
+	TLSReloadInterval time.Duration
+	TLSFromSecret     string
 
 	SSHService string
 
-	DockerCfgRegistry string
-	DockerCfgUsername string
-	DockerCfgPassword string
-	DockerCfgEmail    string
-	DockerCfgAuth     string
+	DockerCfg           []string
+	DockerCfgFile       string
+	DockerCfgFromSecret string
 
 	PrometheusPort   string
 	PrometheusPath   string
@@ -67,41 +88,152 @@ func (cmd *cmdServer) run(c *kingpin.ParseContext) error {
 		panic(err.Error())
 	}
 
+	// Secrets referenced by flags are resolved before the gRPC server boots: --token-file here,
+	// --dockercfg-from-secret and --tls-from-secret below.
+	//
+	// --token-file is watched for the life of the process (fsnotify plus a re-read every
+	// --token-reload-interval), so a rotated token (including one mounted from a Secret) is
+	// enforced by authorize below without a restart.
+	var tokens tokenProvider = staticToken(cmd.Token)
+
+	if cmd.TokenFile != "" {
+		reloader, err := tokenreload.New(cmd.TokenFile, cmd.TokenReloadInterval)
+		if err != nil {
+			panic(err)
+		}
+
+		tokens = reloader
+	}
+
 	log.Println("Booting API")
 
-	// Create a new server which adheres to the GRPC interface.
-	srv, err := server.New(client, config, cmd.Token, cmd.Namespace, cmd.SSHService, cmd.FilesystemSize, cmd.PrometheusApache, server.DockerRegistry{
-		Registry: cmd.DockerCfgRegistry,
-		Username: cmd.DockerCfgUsername,
-		Password: cmd.DockerCfgPassword,
-		Email:    cmd.DockerCfgEmail,
-		Auth:     cmd.DockerCfgAuth,
-	})
+	registries, err := dockerRegistriesFromFlags(cmd.DockerCfg, cmd.DockerCfgFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if cmd.DockerCfgFromSecret != "" {
+		fromSecret, err := dockerRegistriesFromSecret(client, cmd.DockerCfgFromSecret)
+		if err != nil {
+			panic(err)
+		}
+
+		registries = append(registries, fromSecret...)
+	}
+
+	// Create a new server which adheres to the GRPC interface. The token passed here only covers
+	// the static --token case; authorize enforces --token-file/tokens against the current token.
+	srv, err := server.New(client, config, cmd.Token, cmd.Namespace, cmd.SSHService, cmd.FilesystemSize, cmd.PVCStorageClass, cmd.PrometheusApache, registries)
+	if err != nil {
+		panic(err)
+	}
+
+	tlsConfig, err := tlsConfigForProfile(cmd.TLSProfile)
 	if err != nil {
 		panic(err)
 	}
 
 	var creds credentials.TransportCredentials
 
-	// Attempt to load user provided certificates.
-	// If no certificates are provided, fallback to Lets Encrypt.
-	if cmd.TLSCert != "" && cmd.TLSKey != "" {
-		creds, err = credentials.NewServerTLSFromFile(cmd.TLSCert, cmd.TLSKey)
+	// Attempt to load user provided certificates, either from disk or from a Secret. If neither
+	// is provided, fallback to Lets Encrypt.
+	switch {
+	case cmd.TLSCert != "" && cmd.TLSKey != "":
+		reloader, err := tlsreload.New(cmd.TLSCert, cmd.TLSKey, cmd.TLSReloadInterval)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		creds, err = getLetsEncrypt(cmd.LetsEncryptDomain, cmd.LetsEncryptEmail, cmd.LetsEncryptCache)
+
+		config := *tlsConfig
+		config.GetCertificate = reloader.GetCertificate
+		creds = credentials.NewTLS(&config)
+	case cmd.TLSFromSecret != "":
+		namespace, name, err := splitNamespacedName(cmd.TLSFromSecret)
+		if err != nil {
+			panic(err)
+		}
+
+		reloader, err := tlsreload.NewFromSecret(client, namespace, name)
+		if err != nil {
+			panic(err)
+		}
+
+		config := *tlsConfig
+		config.GetCertificate = reloader.GetCertificate
+		creds = credentials.NewTLS(&config)
+	default:
+		creds, err = getLetsEncrypt(cmd.LetsEncryptDomain, cmd.LetsEncryptEmail, cmd.LetsEncryptCache, cmd.LetsEncryptCAServer, tlsConfig)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	grpcServer := grpc.NewServer(grpc.Creds(creds), grpc.UnaryInterceptor(authUnary(tokens)), grpc.StreamInterceptor(authStream(tokens)))
 	pb.RegisterM8SServer(grpcServer, srv)
 	return grpcServer.Serve(listen)
 }
 
+// tokenProvider supplies the current auth token for each incoming RPC, so --token-file can
+// rotate its contents without a restart while a plain --token stays fixed for the process
+// lifetime.
+type tokenProvider interface {
+	Token() string
+}
+
+// staticToken implements tokenProvider for a token supplied directly via --token or
+// $M8S_AUTH_TOKEN, which can only change by restarting the process.
+type staticToken string
+
+// Token implements tokenProvider.
+func (s staticToken) Token() string {
+	return string(s)
+}
+
+// authUnary rejects unary RPCs whose "token" metadata doesn't match tokens' current value, so a
+// rotated --token-file credential takes effect immediately instead of only at the next restart.
+func authUnary(tokens tokenProvider) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, tokens); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// authStream is the streaming equivalent of authUnary.
+func authStream(tokens tokenProvider) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), tokens); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// authorize compares the "token" metadata on ctx against tokens' current value, in constant time
+// so a valid token can't be inferred from response timing. No token configured means auth is
+// disabled, matching the historical behaviour of an empty --token.
+func authorize(ctx context.Context, tokens tokenProvider) error {
+	expected := tokens.Token()
+	if expected == "" {
+		return nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing token")
+	}
+
+	values := md.Get("token")
+	if len(values) != 1 || subtle.ConstantTimeCompare([]byte(values[0]), []byte(expected)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	return nil
+}
+
 // Server declares the "server" sub command.
 func Server(app *kingpin.Application) {
 	c := new(cmdServer)
@@ -112,24 +244,32 @@ func Server(app *kingpin.Application) {
 	cmd.Flag("key", "Private key for TLS connection").Default("").OverrideDefaultFromEnvar("M8S_TLS_KEY").StringVar(&c.TLSKey)
 
 	cmd.Flag("token", "Token to authenticate against the API.").Default("").OverrideDefaultFromEnvar("M8S_AUTH_TOKEN").StringVar(&c.Token)
+	cmd.Flag("token-file", "Path to a file containing the token to authenticate against the API, taking precedence over --token").Default("").OverrideDefaultFromEnvar("M8S_AUTH_TOKEN_FILE").StringVar(&c.TokenFile)
+	cmd.Flag("token-reload-interval", "Fallback interval to re-read --token-file from disk, in case filesystem notifications are missed").Default("1m").OverrideDefaultFromEnvar("M8S_TOKEN_RELOAD_INTERVAL").DurationVar(&c.TokenReloadInterval)
 	cmd.Flag("namespace", "Namespace to build environments.").Default("default").OverrideDefaultFromEnvar("M8S_NAMESPACE").StringVar(&c.Namespace)
 
 	cmd.Flag("fs-size", "Size of the filesystem for persistent storage").Default("100Gi").OverrideDefaultFromEnvar("M8S_FS_SIZE").StringVar(&c.FilesystemSize)
 
+	cmd.Flag("pvc-storage-class", "Default storage class to request for PersistentVolumeClaims").Default("cache").OverrideDefaultFromEnvar("M8S_PVC_STORAGE_CLASS").StringVar(&c.PVCStorageClass)
+
 	// Lets Encrypt.
 	cmd.Flag("lets-encrypt-email", "Email address to register with Lets Encrypt certificate").Default("admin@previousnext.com.au").OverrideDefaultFromEnvar("M8S_LETS_ENCRYPT_EMAIL").StringVar(&c.LetsEncryptEmail)
-	cmd.Flag("lets-encrypt-domain", "Domain to use for Lets Encrypt certificate").Default("").OverrideDefaultFromEnvar("M8S_LETS_ENCRYPT_DOMAIN").StringVar(&c.LetsEncryptDomain)
+	cmd.Flag("lets-encrypt-domain", "Domain(s) to use for Lets Encrypt certificate. Repeatable, and each value may be comma-separated").Default("").OverrideDefaultFromEnvar("M8S_LETS_ENCRYPT_DOMAIN").StringsVar(&c.LetsEncryptDomain)
 	cmd.Flag("lets-encrypt-cache", "Cache directory to use for Lets Encrypt").Default("/tmp").OverrideDefaultFromEnvar("M8S_LETS_ENCRYPT_CACHE").StringVar(&c.LetsEncryptCache)
+	cmd.Flag("lets-encrypt-ca-server", "ACME CA directory URL to request certificates from").Default(acme.LetsEncryptURL).OverrideDefaultFromEnvar("M8S_LETS_ENCRYPT_CA_SERVER").StringVar(&c.LetsEncryptCAServer)
+
+	// TLS.
+	cmd.Flag("tls-profile", "TLS hardening profile to apply: secure, default or legacy").Default("default").OverrideDefaultFromEnvar("M8S_TLS_PROFILE").EnumVar(&c.TLSProfile, "secure", "default", "legacy")
+	cmd.Flag("tls-reload-interval", "Fallback interval to re-read --cert/--key from disk, in case filesystem notifications are missed").Default("5m").OverrideDefaultFromEnvar("M8S_TLS_RELOAD_INTERVAL").DurationVar(&c.TLSReloadInterval)
+	cmd.Flag("tls-from-secret", "namespace/name of a kubernetes.io/tls Secret to use instead of --cert/--key, reloaded when the Secret changes").Default("").OverrideDefaultFromEnvar("M8S_TLS_FROM_SECRET").StringVar(&c.TLSFromSecret)
 
 	// SSH Server.
 	cmd.Flag("ssh-service", "SSH server image to deploy").Default("ssh-server").OverrideDefaultFromEnvar("M8S_SSH_SERVICE").StringVar(&c.SSHService)
 
 	// DockerCfg.
-	cmd.Flag("dockercfg-registry", "Registry for Docker Hub credentials").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_REGISTRY").StringVar(&c.DockerCfgRegistry)
-	cmd.Flag("dockercfg-username", "Username for Docker Hub credentials").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_USERNAME").StringVar(&c.DockerCfgUsername)
-	cmd.Flag("dockercfg-password", "Password for Docker Hub credentials").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_PASSWORD").StringVar(&c.DockerCfgPassword)
-	cmd.Flag("dockercfg-email", "Email for Docker Hub credentials").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_EMAIL").StringVar(&c.DockerCfgEmail)
-	cmd.Flag("dockercfg-auth", "Auth token for Docker Hub credentials").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_AUTH").StringVar(&c.DockerCfgAuth)
+	cmd.Flag("dockercfg", "Private registry credentials, as registry=URL,username=...,password=...,email=...,auth=.... Repeatable, one per registry").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG").StringsVar(&c.DockerCfg)
+	cmd.Flag("dockercfg-file", "Path to a pre-built ~/.docker/config.json to merge into the generated pull secret").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_FILE").StringVar(&c.DockerCfgFile)
+	cmd.Flag("dockercfg-from-secret", "namespace/name of a kubernetes.io/dockerconfigjson Secret to merge into the generated pull secret, read once at startup").Default("").OverrideDefaultFromEnvar("M8S_DOCKERCFG_FROM_SECRET").StringVar(&c.DockerCfgFromSecret)
 
 	// Promtheus.
 	cmd.Flag("prometheus-port", "Prometheus metrics port").Default(":9000").OverrideDefaultFromEnvar("M8S_METRICS_PORT").StringVar(&c.PrometheusPort)
@@ -137,6 +277,133 @@ func Server(app *kingpin.Application) {
 	cmd.Flag("prometheus-apache-exporter", "Prometheus metrics port for Apache on built environments").Default("9117").OverrideDefaultFromEnvar("M8S_METRICS_APACHE_PORT").Int32Var(&c.PrometheusApache)
 }
 
+// dockerConfigJSON mirrors the subset of ~/.docker/config.json needed to merge pre-built
+// credentials supplied via --dockercfg-file alongside --dockercfg entries.
+type dockerConfigJSON struct {
+	Auths map[string]struct {
+		Auth  string `json:"auth"`
+		Email string `json:"email"`
+	} `json:"auths"`
+}
+
+// dockerRegistriesFromFlags builds the full set of registries to authenticate against, combining
+// repeatable --dockercfg tuples with any pre-built Docker config supplied via --dockercfg-file.
+// The result is rendered as a single kubernetes.io/dockerconfigjson Secret with one entry per
+// registry under "auths".
+func dockerRegistriesFromFlags(raw []string, file string) ([]server.DockerRegistry, error) {
+	var registries []server.DockerRegistry
+
+	for _, entry := range raw {
+		registry, err := parseDockerRegistry(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		registries = append(registries, registry)
+	}
+
+	if file == "" {
+		return registries, nil
+	}
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --dockercfg-file: %s", err)
+	}
+
+	var config dockerConfigJSON
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse --dockercfg-file: %s", err)
+	}
+
+	for registry, auth := range config.Auths {
+		registries = append(registries, server.DockerRegistry{
+			Registry: registry,
+			Auth:     auth.Auth,
+			Email:    auth.Email,
+		})
+	}
+
+	return registries, nil
+}
+
+// dockerRegistriesFromSecret fetches a kubernetes.io/dockerconfigjson Secret identified by
+// "namespace/name" and parses its ".dockerconfigjson" entry into registries, the same way
+// --dockercfg-file does for a file on disk.
+func dockerRegistriesFromSecret(client kubernetes.Interface, namespacedName string) ([]server.DockerRegistry, error) {
+	namespace, name, err := splitNamespacedName(namespacedName)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get --dockercfg-from-secret %s: %s", namespacedName, err)
+	}
+
+	var config dockerConfigJSON
+	if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &config); err != nil {
+		return nil, fmt.Errorf("failed to parse --dockercfg-from-secret %s: %s", namespacedName, err)
+	}
+
+	var registries []server.DockerRegistry
+	for registry, auth := range config.Auths {
+		registries = append(registries, server.DockerRegistry{
+			Registry: registry,
+			Auth:     auth.Auth,
+			Email:    auth.Email,
+		})
+	}
+
+	return registries, nil
+}
+
+// splitNamespacedName splits a "namespace/name" Secret reference, as used by
+// --dockercfg-from-secret and --tls-from-secret.
+func splitNamespacedName(value string) (namespace, name string, err error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid secret reference %q: expected namespace/name", value)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// parseDockerRegistry parses a single --dockercfg value of the form
+// "registry=URL,username=...,password=...,email=...,auth=...".
+func parseDockerRegistry(entry string) (server.DockerRegistry, error) {
+	var registry server.DockerRegistry
+
+	for _, pair := range strings.Split(entry, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return registry, fmt.Errorf("invalid --dockercfg entry %q: expected key=value pairs", entry)
+		}
+
+		key, value := parts[0], parts[1]
+		switch key {
+		case "registry":
+			registry.Registry = value
+		case "username":
+			registry.Username = value
+		case "password":
+			registry.Password = value
+		case "email":
+			registry.Email = value
+		case "auth":
+			registry.Auth = value
+		default:
+			return registry, fmt.Errorf("invalid --dockercfg entry %q: unknown key %q", entry, key)
+		}
+	}
+
+	if registry.Registry == "" {
+		return registry, fmt.Errorf("invalid --dockercfg entry %q: missing registry", entry)
+	}
+
+	return registry, nil
+}
+
 // Helper function for serving Prometheus metrics.
 func metrics(port, path string) {
 	http.Handle(path, promhttp.Handler())
@@ -144,13 +411,70 @@ func metrics(port, path string) {
 }
 
 // Helper function for adding Lets Encrypt certificates.
-func getLetsEncrypt(domain, email, cache string) (credentials.TransportCredentials, error) {
+func getLetsEncrypt(domains []string, email, cache, caServer string, tlsConfig *tls.Config) (credentials.TransportCredentials, error) {
 	manager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      autocert.DirCache(cache),
-		HostPolicy: autocert.HostWhitelist(domain),
+		HostPolicy: autocert.HostWhitelist(splitDomains(domains)...),
 		Email:      email,
+		Client:     &acme.Client{DirectoryURL: caServer},
+	}
+
+	config := *tlsConfig
+	config.GetCertificate = tlsreload.Instrument(manager.GetCertificate)
+
+	return credentials.NewTLS(&config), nil
+}
+
+// tlsProfiles declares the fixed set of hardening levels available via --tls-profile, modeled on
+// the secure/default/legacy split used by Pinniped. "secure" speaks TLS 1.3 only, where the cipher
+// suite is not configurable. "default" restricts TLS 1.2 to AEAD suites. "legacy" keeps Go's
+// default suite list for interop with older clients.
+var tlsProfiles = map[string]*tls.Config{
+	"secure": {
+		MinVersion: tls.VersionTLS13,
+	},
+	"default": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	"legacy": {
+		MinVersion: tls.VersionTLS12,
+	},
+}
+
+// tlsConfigForProfile returns a shallow copy of the base tls.Config for a --tls-profile name, so
+// callers can set fields on the result without modifying the shared map entry.
+func tlsConfigForProfile(profile string) (*tls.Config, error) {
+	base, ok := tlsProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls profile: %s", profile)
 	}
 
-	return credentials.NewTLS(&tls.Config{GetCertificate: manager.GetCertificate}), nil
-}
\ No newline at end of file
+	config := *base
+	return &config, nil
+}
+
+// splitDomains flattens a repeatable/comma-separated --lets-encrypt-domain flag into a single
+// list of SANs, eg ["api.example.com,ssh.example.com"] and ["api.example.com", "ssh.example.com"]
+// are treated the same way.
+func splitDomains(domains []string) []string {
+	var hosts []string
+	for _, domain := range domains {
+		for _, host := range strings.Split(domain, ",") {
+			host = strings.TrimSpace(host)
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
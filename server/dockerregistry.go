@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// DockerRegistry holds the credentials needed to authenticate against a single private image
+// registry, as supplied via --dockercfg, --dockercfg-file or --dockercfg-from-secret.
+type DockerRegistry struct {
+	Registry string
+	Username string
+	Password string
+	Email    string
+	Auth     string
+}
+
+// dockerConfigEntry is a single "auths" entry of a .dockerconfigjson payload.
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// PullSecret renders registries into a single kubernetes.io/dockerconfigjson Secret named name in
+// namespace, merging every registry's credentials under "auths" so a build only needs one
+// imagePullSecrets entry regardless of how many private registries its images come from.
+func PullSecret(namespace, name string, registries []DockerRegistry) (*v1.Secret, error) {
+	auths := make(map[string]dockerConfigEntry, len(registries))
+
+	for _, registry := range registries {
+		auth := registry.Auth
+		if auth == "" {
+			auth = base64.StdEncoding.EncodeToString([]byte(registry.Username + ":" + registry.Password))
+		}
+
+		auths[registry.Registry] = dockerConfigEntry{
+			Username: registry.Username,
+			Password: registry.Password,
+			Email:    registry.Email,
+			Auth:     auth,
+		}
+	}
+
+	contents, err := json.Marshal(struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}{Auths: auths})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render dockerconfigjson: %s", err)
+	}
+
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: contents,
+		},
+	}, nil
+}
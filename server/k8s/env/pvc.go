@@ -6,30 +6,55 @@ import (
 	"k8s.io/client-go/pkg/api/v1"
 )
 
+// DefaultStorageClass is applied when a PersistentVolumeClaimInput doesn't specify one, preserving
+// the historical behaviour of every claim landing on the "cache" storage class.
+const DefaultStorageClass = "cache"
+
 // PersistentVolumeClaimInput provides the PersistentVolumeClaim function with information to produce a Kubernetes PersistentVolumeClaim.
 type PersistentVolumeClaimInput struct {
 	Namespace string
 	Name      string
 	Storage   string
+
+	// StorageClass to provision the claim against. Defaults to DefaultStorageClass.
+	StorageClass string
+	// AccessModes to request on the claim. Defaults to ReadWriteMany.
+	AccessModes []v1.PersistentVolumeAccessMode
+	// Selector restricts the claim to pre-provisioned PersistentVolumes matching these labels.
+	Selector *metav1.LabelSelector
+	// VolumeMode requested for the claim, eg Block or Filesystem. Left unset to use the Kubernetes default.
+	VolumeMode *v1.PersistentVolumeMode
 }
 
 // PersistentVolumeClaim is used for creating a new PersistentVolumeClaim object.
 func PersistentVolumeClaim(input PersistentVolumeClaimInput) *v1.PersistentVolumeClaim {
+	class := input.StorageClass
+	if class == "" {
+		class = DefaultStorageClass
+	}
+
+	accessModes := input.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteMany}
+	}
+
 	return &v1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: input.Namespace,
 			Name:      input.Name,
 			Annotations: map[string]string{
-				// Setting this storage class to "cache" allows system admins to register any type of
-				// storage backend for "cache" claims.
-				"volume.beta.kubernetes.io/storage-class": "cache",
+				// Setting this storage class allows system admins to register any type of
+				// storage backend for these claims. Also set below via spec.storageClassName,
+				// the annotation is kept for clusters still relying on the beta form.
+				"volume.beta.kubernetes.io/storage-class": class,
 				"author": "m8s",
 			},
 		},
 		Spec: v1.PersistentVolumeClaimSpec{
-			AccessModes: []v1.PersistentVolumeAccessMode{
-				v1.ReadWriteMany,
-			},
+			AccessModes:      accessModes,
+			StorageClassName: &class,
+			Selector:         input.Selector,
+			VolumeMode:       input.VolumeMode,
 			Resources: v1.ResourceRequirements{
 				Requests: v1.ResourceList{
 					v1.ResourceStorage: resource.MustParse(input.Storage),
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/previousnext/m8s/server/k8s/env"
+)
+
+// PersistentVolumeClaim builds the PersistentVolumeClaim for an environment named name in
+// namespace, applying storageClass (as configured via --pvc-storage-class) so operators aren't
+// stuck on env.DefaultStorageClass.
+func PersistentVolumeClaim(namespace, name, storage, storageClass string) *v1.PersistentVolumeClaim {
+	return env.PersistentVolumeClaim(env.PersistentVolumeClaimInput{
+		Namespace:    namespace,
+		Name:         name,
+		Storage:      storage,
+		StorageClass: storageClass,
+	})
+}
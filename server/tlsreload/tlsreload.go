@@ -0,0 +1,246 @@
+// Package tlsreload watches a certificate/key pair on disk and serves whatever is currently
+// there via a tls.Config.GetCertificate callback, so rotating Lets Encrypt or cert-manager
+// managed material takes effect in-process without a pod restart.
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	certNotAfter = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "m8s_tls_cert_not_after_seconds",
+		Help: "Unix timestamp of the expiry of the TLS certificate currently being served.",
+	})
+	reloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "m8s_tls_cert_reload_total",
+		Help: "Count of TLS certificate reload attempts, labelled by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(certNotAfter, reloadTotal)
+}
+
+// Reloader serves the TLS certificate currently on disk at CertFile/KeyFile, reloading it
+// whenever the files change.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// New creates a Reloader, loads the initial certificate, and starts watching CertFile/KeyFile
+// for changes. fallback is a periodic re-read interval that runs alongside the fsnotify watch,
+// since inotify events are commonly missed on ConfigMap/Secret projected volumes, which rotate
+// via an atomic symlink swap rather than an in-place write.
+func New(certFile, keyFile string, fallback time.Duration) (*Reloader, error) {
+	if fallback <= 0 {
+		return nil, fmt.Errorf("tlsreload: fallback interval must be positive, got %s", fallback)
+	}
+
+	r := &Reloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	go r.watch(fallback)
+
+	return r, nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate callback.
+func (r *Reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *Reloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		reloadTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	reloadTotal.WithLabelValues("success").Inc()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		certNotAfter.Set(float64(leaf.NotAfter.Unix()))
+	}
+
+	return nil
+}
+
+// SecretReloader serves the TLS certificate currently stored in a kubernetes.io/tls Secret,
+// reloading it whenever that Secret is updated. This is the equivalent of Reloader for
+// certificates sourced via --tls-from-secret instead of --cert/--key.
+type SecretReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewFromSecret creates a SecretReloader, loads the initial certificate from the "tls.crt"/
+// "tls.key" keys of the Secret "name" in "namespace", and starts watching it for updates.
+func NewFromSecret(client kubernetes.Interface, namespace, name string) (*SecretReloader, error) {
+	r := &SecretReloader{}
+
+	secret, err := client.Core().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.set(secret); err != nil {
+		return nil, err
+	}
+
+	// Start the watch from the resourceVersion we just read, so an update landing between the
+	// Get above and the Watch call below is still delivered instead of silently missed.
+	go r.watch(client, namespace, name, secret.ResourceVersion)
+
+	return r, nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate callback.
+func (r *SecretReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *SecretReloader) set(secret *v1.Secret) error {
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		reloadTotal.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	reloadTotal.WithLabelValues("success").Inc()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		certNotAfter.Set(float64(leaf.NotAfter.Unix()))
+	}
+
+	return nil
+}
+
+// watch re-reads the certificate every time the Secret changes, starting from resourceVersion so
+// no update between the caller's initial Get and the watch being established is missed, and
+// reconnecting with the latest known resourceVersion if the watch is dropped by the API server.
+func (r *SecretReloader) watch(client kubernetes.Interface, namespace, name, resourceVersion string) {
+	for {
+		watcher, err := client.Core().Secrets(namespace).Watch(metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			log.Printf("tlsreload: failed to watch secret %s/%s, retrying in 30s: %v", namespace, name, err)
+			time.Sleep(30 * time.Second)
+			continue
+		}
+
+		for event := range watcher.ResultChan() {
+			secret, ok := event.Object.(*v1.Secret)
+			if !ok {
+				continue
+			}
+
+			resourceVersion = secret.ResourceVersion
+
+			if err := r.set(secret); err != nil {
+				log.Printf("tlsreload: failed to reload certificate from secret %s/%s: %v", namespace, name, err)
+			}
+		}
+
+		watcher.Stop()
+	}
+}
+
+// Instrument wraps a tls.Config.GetCertificate callback, such as autocert.Manager.GetCertificate,
+// keeping m8s_tls_cert_not_after_seconds up to date for that source too. Unlike Reloader it
+// doesn't touch m8s_tls_cert_reload_total, since autocert calls GetCertificate once per
+// handshake rather than once per renewal, and counting every handshake would make the reload
+// counter meaningless.
+func Instrument(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			certNotAfter.Set(float64(leaf.NotAfter.Unix()))
+		}
+
+		return cert, nil
+	}
+}
+
+// watch reloads the certificate whenever CertFile or KeyFile change, falling back to a plain
+// polling loop if the fsnotify watcher can't be started.
+func (r *Reloader) watch(fallback time.Duration) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("tlsreload: fsnotify unavailable, falling back to polling every %s: %v", fallback, err)
+		watcher = nil
+	} else {
+		defer watcher.Close()
+
+		for _, file := range []string{r.CertFile, r.KeyFile} {
+			if err := watcher.Add(file); err != nil {
+				log.Printf("tlsreload: failed to watch %s: %v", file, err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(fallback)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if err := r.reload(); err != nil {
+			log.Printf("tlsreload: failed to reload certificate: %v", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package tokenreload watches the file backing --token-file and serves whatever token is
+// currently there, so rotating credentials takes effect in-process without a pod restart.
+package tokenreload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Reloader serves the token currently on disk at TokenFile, reloading it whenever the file
+// changes.
+type Reloader struct {
+	TokenFile string
+
+	mu    sync.RWMutex
+	token string
+}
+
+// New creates a Reloader, loads the initial token, and starts watching TokenFile for changes.
+// fallback is a periodic re-read interval that runs alongside the fsnotify watch, since inotify
+// events are commonly missed on ConfigMap/Secret projected volumes, which rotate via an atomic
+// symlink swap rather than an in-place write.
+func New(tokenFile string, fallback time.Duration) (*Reloader, error) {
+	if fallback <= 0 {
+		return nil, fmt.Errorf("tokenreload: fallback interval must be positive, got %s", fallback)
+	}
+
+	r := &Reloader{TokenFile: tokenFile}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	go r.watch(fallback)
+
+	return r, nil
+}
+
+// Token returns the token currently loaded from TokenFile.
+func (r *Reloader) Token() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.token
+}
+
+func (r *Reloader) reload() error {
+	contents, err := ioutil.ReadFile(r.TokenFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.token = strings.TrimSpace(string(contents))
+	r.mu.Unlock()
+
+	return nil
+}
+
+// watch reloads the token whenever TokenFile changes, falling back to a plain polling loop if
+// the fsnotify watcher can't be started.
+func (r *Reloader) watch(fallback time.Duration) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("tokenreload: fsnotify unavailable, falling back to polling every %s: %v", fallback, err)
+		watcher = nil
+	} else {
+		defer watcher.Close()
+
+		if err := watcher.Add(r.TokenFile); err != nil {
+			log.Printf("tokenreload: failed to watch %s: %v", r.TokenFile, err)
+		}
+	}
+
+	ticker := time.NewTicker(fallback)
+	defer ticker.Stop()
+
+	var events <-chan fsnotify.Event
+	if watcher != nil {
+		events = watcher.Events
+	}
+
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if err := r.reload(); err != nil {
+			log.Printf("tokenreload: failed to reload token: %v", err)
+		}
+	}
+}
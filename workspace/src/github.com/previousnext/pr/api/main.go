@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"crypto/tls"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/alecthomas/kingpin"
 	"github.com/previousnext/pr/api/k8s/addons"
 	pb "github.com/previousnext/pr/pb"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -27,9 +29,13 @@ var (
 	cliCacheSize = kingpin.Flag("cache-size", "Size of the shared cache used between builds").Default("100Gi").OverrideDefaultFromEnvar("CACHE_SIZE").String()
 
 	// Lets Encrypt.
-	cliLetsEncryptEmail  = kingpin.Flag("lets-encrypt-email", "Email address to register with Lets Encrypt certificate").Default("admin@previousnext.com.au").OverrideDefaultFromEnvar("LETS_ENCRYPT_EMAIL").String()
-	cliLetsEncryptDomain = kingpin.Flag("lets-encrypt-domain", "Domain to use for Lets Encrypt certificate").Default("").OverrideDefaultFromEnvar("LETS_ENCRYPT_DOMAIN").String()
-	cliLetsEncryptCache  = kingpin.Flag("lets-encrypt-cache", "Cache directory to use for Lets Encrypt").Default("/tmp").OverrideDefaultFromEnvar("LETS_ENCRYPT_CACHE").String()
+	cliLetsEncryptEmail    = kingpin.Flag("lets-encrypt-email", "Email address to register with Lets Encrypt certificate").Default("admin@previousnext.com.au").OverrideDefaultFromEnvar("LETS_ENCRYPT_EMAIL").String()
+	cliLetsEncryptDomain   = kingpin.Flag("lets-encrypt-domain", "Domain(s) to use for Lets Encrypt certificate. Repeatable, and each value may be comma-separated").Default("").OverrideDefaultFromEnvar("LETS_ENCRYPT_DOMAIN").Strings()
+	cliLetsEncryptCache    = kingpin.Flag("lets-encrypt-cache", "Cache directory to use for Lets Encrypt").Default("/tmp").OverrideDefaultFromEnvar("LETS_ENCRYPT_CACHE").String()
+	cliLetsEncryptCAServer = kingpin.Flag("lets-encrypt-ca-server", "ACME CA directory URL to request certificates from").Default(acme.LetsEncryptURL).OverrideDefaultFromEnvar("LETS_ENCRYPT_CA_SERVER").String()
+
+	// TLS.
+	cliTLSProfile = kingpin.Flag("tls-profile", "TLS hardening profile to apply: secure, default or legacy").Default("default").Enum("secure", "default", "legacy")
 
 	// Black Death.
 	cliBlackDeathImage   = kingpin.Flag("black-death-image", "Black Death image to deploy").Default("previousnext/k8s-black-death").OverrideDefaultFromEnvar("BLACK_DEATH_IMAGE").String()
@@ -96,17 +102,26 @@ func main() {
 		config: config,
 	}
 
+	tlsConfig, err := tlsConfigForProfile(*cliTLSProfile)
+	if err != nil {
+		panic(err)
+	}
+
 	var creds credentials.TransportCredentials
 
 	// Attempt to load user provided certificates.
 	// If no certificates are provided, fallback to Lets Encrypt.
 	if *cliCert != "" && *cliKey != "" {
-		creds, err = credentials.NewServerTLSFromFile(*cliCert, *cliKey)
+		cert, err := tls.LoadX509KeyPair(*cliCert, *cliKey)
 		if err != nil {
 			panic(err)
 		}
+
+		config := *tlsConfig
+		config.Certificates = []tls.Certificate{cert}
+		creds = credentials.NewTLS(&config)
 	} else {
-		creds, err = getLetsEncrypt(*cliLetsEncryptDomain, *cliLetsEncryptEmail, *cliLetsEncryptCache)
+		creds, err = getLetsEncrypt(*cliLetsEncryptDomain, *cliLetsEncryptEmail, *cliLetsEncryptCache, *cliLetsEncryptCAServer, tlsConfig)
 		if err != nil {
 			panic(err)
 		}
@@ -118,12 +133,70 @@ func main() {
 }
 
 // Helper function for adding Lets Encrypt certificates.
-func getLetsEncrypt(domain, email, cache string) (credentials.TransportCredentials, error) {
+func getLetsEncrypt(domains []string, email, cache, caServer string, tlsConfig *tls.Config) (credentials.TransportCredentials, error) {
 	manager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      autocert.DirCache(cache),
-		HostPolicy: autocert.HostWhitelist(domain),
+		HostPolicy: autocert.HostWhitelist(splitDomains(domains)...),
 		Email:      email,
+		Client:     &acme.Client{DirectoryURL: caServer},
+	}
+
+	config := *tlsConfig
+	config.GetCertificate = manager.GetCertificate
+
+	return credentials.NewTLS(&config), nil
+}
+
+// tlsProfiles declares the fixed set of hardening levels available via --tls-profile, modeled on
+// the secure/default/legacy split used by Pinniped. "secure" speaks TLS 1.3 only, where the cipher
+// suite is not configurable. "default" restricts TLS 1.2 to AEAD suites. "legacy" keeps Go's
+// default suite list for interop with older clients.
+var tlsProfiles = map[string]*tls.Config{
+	"secure": {
+		MinVersion: tls.VersionTLS13,
+	},
+	"default": {
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	},
+	"legacy": {
+		MinVersion: tls.VersionTLS12,
+	},
+}
+
+// tlsConfigForProfile returns a shallow copy of the base tls.Config for a --tls-profile name, so
+// callers can set fields on the result without modifying the shared map entry.
+func tlsConfigForProfile(profile string) (*tls.Config, error) {
+	base, ok := tlsProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls profile: %s", profile)
+	}
+
+	config := *base
+	return &config, nil
+}
+
+// splitDomains flattens a repeatable/comma-separated --lets-encrypt-domain flag into a single
+// list of SANs, eg ["api.example.com,ssh.example.com"] and ["api.example.com", "ssh.example.com"]
+// are treated the same way.
+func splitDomains(domains []string) []string {
+	var hosts []string
+	for _, domain := range domains {
+		for _, host := range strings.Split(domain, ",") {
+			host = strings.TrimSpace(host)
+			if host != "" {
+				hosts = append(hosts, host)
+			}
+		}
 	}
-	return credentials.NewTLS(&tls.Config{GetCertificate: manager.GetCertificate}), nil
+	return hosts
 }